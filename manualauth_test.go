@@ -0,0 +1,41 @@
+package oauth2ns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestManualAuthenticate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"test-token","token_type":"bearer"}`))
+	}))
+	defer srv.Close()
+
+	oauthConfig := &oauth2.Config{
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: srv.URL},
+	}
+
+	client, err := manualAuthenticate(context.Background(), context.Background(), oauthConfig, "https://example.com/authorize", strings.NewReader("pasted-code\n"))
+	if err != nil {
+		t.Fatalf("manualAuthenticate() error = %v", err)
+	}
+	if client.Token.AccessToken != "test-token" {
+		t.Errorf("AccessToken = %q, want %q", client.Token.AccessToken, "test-token")
+	}
+}
+
+func TestManualAuthenticateNoInput(t *testing.T) {
+	oauthConfig := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: "https://example.com/token"}}
+
+	if _, err := manualAuthenticate(context.Background(), context.Background(), oauthConfig, "https://example.com/authorize", strings.NewReader("")); err == nil {
+		t.Fatal("manualAuthenticate() with no input, error = nil, want error")
+	}
+}
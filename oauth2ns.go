@@ -1,16 +1,23 @@
 package oauth2ns
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"strconv"
+	"os"
+	"strings"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/fatih/color"
 	rndm "github.com/nmrshll/rndm-go"
 	"github.com/palantir/stacktrace"
@@ -24,15 +31,121 @@ type AuthorizedClient struct {
 }
 
 const (
-	// PORT is the port that the temporary oauth server will listen on
-	PORT                       = 14565
 	oauthStateStringContextKey = 987
-	serverWaitTimeout = 40 * time.Second
+
+	// defaultAuthTimeout bounds how long AuthenticateUser waits for the
+	// provider redirect before giving up. In WithManualAuth mode the deadline
+	// applies to the token exchange; reading the pasted-back code is not
+	// interrupted by it. Override with WithTimeout.
+	defaultAuthTimeout = 40 * time.Second
+
+	// defaultListenAddress is used when neither WithListener nor
+	// WithListenAddress is given: loopback-only, with the kernel picking a
+	// free port to avoid collisions between concurrent auth attempts.
+	defaultListenAddress = "127.0.0.1:0"
+	defaultCallbackPath  = "/oauth/callback"
+
+	// oobRedirectURI asks the provider to display the authorization code to
+	// the user instead of redirecting to a listener, for use in headless
+	// environments (SSH sessions, containers, CI).
+	oobRedirectURI = "urn:ietf:wg:oauth:2.0:oob"
+
+	// defaultMinTokenValidity is how much life a cached token must have left
+	// before AuthenticateUser will hand it out without first trying to
+	// refresh it.
+	defaultMinTokenValidity = 10 * time.Minute
+
+	// pkceVerifierLength is the number of random bytes used to build the
+	// code_verifier. Base64url-encoding 96 bytes yields a 128 char string,
+	// the maximum allowed by RFC 7636.
+	pkceVerifierLength = 96
+	pkceMethodS256     = "S256"
+	pkceMethodPlain    = "plain"
+
+	// defaultAutoCloseSeconds is how long the success page waits before
+	// closing its tab.
+	defaultAutoCloseSeconds = 4
+)
+
+// ResponsePageData is the data made available to the success/error response
+// templates (see WithResponseTemplate and WithErrorResponseTemplate).
+type ResponsePageData struct {
+	Title            string
+	Message          string
+	AutoCloseSeconds int
+	ProviderName     string
+
+	// ScriptNonce is the CSP nonce that authorizes the default success
+	// page's inline auto-close <script>. It's empty on the error page, so
+	// a custom template that doesn't reference it keeps a script-free CSP.
+	ScriptNonce string
+}
+
+const defaultSuccessPageHTML = `
+<div style="height:100px; width:100%!; display:flex; flex-direction: column; justify-content: center; align-items:center; background-color:#2ecc71; color:white; font-size:22"><div>{{.Title}}</div></div>
+<p style="margin-top:20px; font-size:18; text-align:center">{{.Message}}</p>
+{{if .ProviderName}}<p style="margin-top:10px; font-size:14; text-align:center; color:#888">{{.ProviderName}}</p>{{end}}
+<script nonce="{{.ScriptNonce}}">window.onload=function(){setTimeout(this.close, {{.AutoCloseSeconds}}*1000)}</script>
+`
+
+const defaultErrorPageHTML = `
+<div style="height:100px; width:100%!; display:flex; flex-direction: column; justify-content: center; align-items:center; background-color:#e74c3c; color:white; font-size:22"><div>{{.Title}}</div></div>
+<p style="margin-top:20px; font-size:18; text-align:center">{{.Message}}</p>
+{{if .ProviderName}}<p style="margin-top:10px; font-size:14; text-align:center; color:#888">{{.ProviderName}}</p>{{end}}
+`
+
+var (
+	defaultSuccessTemplate = template.Must(template.New("oauth2ns-success").Parse(defaultSuccessPageHTML))
+	defaultErrorTemplate   = template.Must(template.New("oauth2ns-error").Parse(defaultErrorPageHTML))
 )
 
+// setSecurityHeaders marks the callback response as non-embeddable and
+// non-leaking: it carries an authorization code and should never be framed
+// or sent along as a referrer. scriptNonce, when non-empty, allows exactly
+// the one inline <script nonce="..."> tag carrying it through CSP; pass ""
+// for responses (like the error page) that have no script, keeping them on
+// a script-free policy instead of a blanket 'unsafe-inline'.
+func setSecurityHeaders(w http.ResponseWriter, scriptNonce string) {
+	h := w.Header()
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Referrer-Policy", "no-referrer")
+	csp := "default-src 'none'; style-src 'unsafe-inline'"
+	if scriptNonce != "" {
+		csp += fmt.Sprintf("; script-src 'nonce-%s'", scriptNonce)
+	}
+	h.Set("Content-Security-Policy", csp)
+	h.Set("X-Content-Type-Options", "nosniff")
+}
+
+// cspNonce returns a fresh random value for a CSP script-src nonce.
+func cspNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", stacktrace.Propagate(err, "failed generating CSP nonce")
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
 type AuthenticateUserOption func(*AuthenticateUserFuncConfig) error
 type AuthenticateUserFuncConfig struct {
 	AuthCallHTTPParams url.Values
+	PKCE               bool
+	PKCEMethod         string
+	ListenAddress      string
+	Listener           net.Listener
+	CallbackPath       string
+	RedirectURL        string
+	ManualAuth         bool
+	ManualAuthInput    io.Reader
+	SessionCache       SessionCache
+	MinTokenValidity   time.Duration
+	Timeout            time.Duration
+	SuccessTemplate    *template.Template
+	ErrorTemplate      *template.Template
+	ProviderName       string
+	AutoCloseSeconds   int
+	HTTPClient         *http.Client
+	InsecureSkipVerify bool
 }
 
 func WithAuthCallHTTPParams(values url.Values) AuthenticateUserOption {
@@ -42,8 +155,232 @@ func WithAuthCallHTTPParams(values url.Values) AuthenticateUserOption {
 	}
 }
 
-// AuthenticateUser starts the login process
-func AuthenticateUser(oauthConfig *oauth2.Config, options ...AuthenticateUserOption) (*AuthorizedClient, error) {
+// WithPKCE enables RFC 7636 Proof Key for Code Exchange, generating a fresh
+// code_verifier/code_challenge pair for each authorization attempt. Use this
+// for public clients (native apps, CLIs) talking to providers such as
+// Google, Okta or Auth0 that require PKCE for installed apps.
+func WithPKCE() AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.PKCE = true
+		if conf.PKCEMethod == "" {
+			conf.PKCEMethod = pkceMethodS256
+		}
+		return nil
+	}
+}
+
+// WithPKCEMethod enables PKCE using the given code_challenge_method
+// ("S256" or "plain"). Providers that can't compute SHA256 challenges
+// accept "plain" as a fallback.
+func WithPKCEMethod(method string) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		if method != pkceMethodS256 && method != pkceMethodPlain {
+			return stacktrace.NewError("unsupported PKCE method '%s'", method)
+		}
+		conf.PKCE = true
+		conf.PKCEMethod = method
+		return nil
+	}
+}
+
+// generatePKCECodeVerifier returns a cryptographically-random code_verifier
+// using the unreserved URL character set from RFC 7636 section 4.1.
+func generatePKCECodeVerifier() (string, error) {
+	b := make([]byte, pkceVerifierLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", stacktrace.Propagate(err, "failed generating PKCE code_verifier")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceCodeChallenge derives the code_challenge for the given verifier and method.
+func pkceCodeChallenge(verifier, method string) string {
+	if method == pkceMethodPlain {
+		return verifier
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// WithListenAddress sets the address the temporary callback server binds to,
+// e.g. "127.0.0.1:0" to let the kernel pick a free port (the default), or a
+// fixed "127.0.0.1:PORT" if the OAuth app is registered with a fixed
+// redirect URI. Ignored if WithListener is also given.
+func WithListenAddress(addr string) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.ListenAddress = addr
+		return nil
+	}
+}
+
+// WithListener hands AuthenticateUser a caller-managed net.Listener instead
+// of having it call net.Listen itself. Takes priority over WithListenAddress.
+func WithListener(l net.Listener) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.Listener = l
+		return nil
+	}
+}
+
+// WithCallbackPath overrides the default "/oauth/callback" path the
+// temporary server listens on.
+func WithCallbackPath(path string) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.CallbackPath = path
+		return nil
+	}
+}
+
+// WithRedirectURL overrides the redirect URL advertised to the provider,
+// bypassing auto-detection from the listener address. Use this for
+// providers that reject bare loopback redirect URIs and instead require a
+// public hostname (e.g. "https://localhost.example.com:PORT/oauth/callback")
+// that resolves back to the loopback listener.
+func WithRedirectURL(redirectURL string) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.RedirectURL = redirectURL
+		return nil
+	}
+}
+
+// WithManualAuth switches AuthenticateUser into a no-server, copy-paste flow:
+// the authorization URL is printed to stdout and the user pastes back the
+// authorization code on stdin, instead of the library opening a browser and
+// listening for the provider's redirect. Use this for SSH sessions,
+// containers, and CI where no browser-reachable redirect is possible.
+func WithManualAuth() AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.ManualAuth = true
+		return nil
+	}
+}
+
+// WithManualAuthInput overrides where WithManualAuth reads the pasted-back
+// authorization code from. Defaults to os.Stdin; mainly useful for tests.
+func WithManualAuthInput(r io.Reader) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.ManualAuthInput = r
+		return nil
+	}
+}
+
+// WithSessionCache lets AuthenticateUser look up and store tokens in cache
+// instead of always running the interactive flow, and substitute a custom
+// backend (e.g. an OS keychain) for the default file-based cache.
+func WithSessionCache(cache SessionCache) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.SessionCache = cache
+		return nil
+	}
+}
+
+// WithMinTokenValidity overrides how much life a cached token must have left
+// (defaultMinTokenValidity otherwise) before it's returned without first
+// attempting a refresh.
+func WithMinTokenValidity(d time.Duration) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.MinTokenValidity = d
+		return nil
+	}
+}
+
+// WithTimeout overrides how long AuthenticateUser waits for authentication to
+// complete (defaultAuthTimeout otherwise) before cancelling the context
+// passed to the callback server and the token exchange.
+func WithTimeout(d time.Duration) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.Timeout = d
+		return nil
+	}
+}
+
+// WithResponseTemplate overrides the HTML page shown to the user in their
+// browser after a successful callback. The template is executed with a
+// ResponsePageData. The response's CSP only allows scripts carrying the
+// page's ResponsePageData.ScriptNonce, so any inline <script> in a custom
+// template must add nonce="{{.ScriptNonce}}" or it will be silently blocked
+// by the browser.
+func WithResponseTemplate(tmpl *template.Template) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.SuccessTemplate = tmpl
+		return nil
+	}
+}
+
+// WithErrorResponseTemplate overrides the HTML page shown to the user when
+// the callback fails (state mismatch or a failed token exchange). The
+// template is executed with a ResponsePageData.
+func WithErrorResponseTemplate(tmpl *template.Template) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.ErrorTemplate = tmpl
+		return nil
+	}
+}
+
+// WithProviderName sets the ResponsePageData.ProviderName shown on the
+// success/error pages, for providers that want their own branding there.
+func WithProviderName(name string) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.ProviderName = name
+		return nil
+	}
+}
+
+// WithAutoCloseSeconds overrides how long the success page waits
+// (defaultAutoCloseSeconds otherwise) before closing its tab.
+func WithAutoCloseSeconds(seconds int) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.AutoCloseSeconds = seconds
+		return nil
+	}
+}
+
+// WithHTTPClient overrides the *http.Client used for the token exchange and
+// for AuthorizedClient.Client. Takes priority over WithInsecureSkipVerify.
+func WithHTTPClient(client *http.Client) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.HTTPClient = client
+		return nil
+	}
+}
+
+// WithInsecureSkipVerify disables TLS certificate verification for the
+// token exchange, e.g. against a provider using a self-signed certificate in
+// local development. Off by default; do not use against production
+// providers.
+func WithInsecureSkipVerify(skip bool) AuthenticateUserOption {
+	return func(conf *AuthenticateUserFuncConfig) error {
+		conf.InsecureSkipVerify = skip
+		return nil
+	}
+}
+
+// cachedClient returns an AuthorizedClient for token if it's still valid for
+// at least minValidity, or can be refreshed; otherwise it returns nil so the
+// caller falls through to the interactive flow. ctx bounds the immediate
+// refresh call below (so it still honors the calling attempt's timeout);
+// clientCtx is long-lived and is what the returned client's token source
+// uses for future refreshes (see the clientCtx comment in AuthenticateUser).
+func cachedClient(ctx, clientCtx context.Context, oauthConfig *oauth2.Config, token *oauth2.Token, minValidity time.Duration) *AuthorizedClient {
+	if token == nil {
+		return nil
+	}
+	if token.Valid() && (token.Expiry.IsZero() || time.Until(token.Expiry) > minValidity) {
+		return &AuthorizedClient{oauthConfig.Client(clientCtx, token), token}
+	}
+	// pass only the refresh token: given the full token, TokenSource would hand
+	// back the same still-valid access token instead of refreshing it
+	refreshed, err := oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+	if err != nil {
+		return nil
+	}
+	return &AuthorizedClient{oauthConfig.Client(clientCtx, refreshed), refreshed}
+}
+
+// AuthenticateUser starts the login process. The supplied ctx governs the
+// whole attempt: cancelling it (or its deadline expiring) shuts down the
+// callback server and aborts the token exchange.
+func AuthenticateUser(ctx context.Context, oauthConfig *oauth2.Config, options ...AuthenticateUserOption) (*AuthorizedClient, error) {
 	// validate params
 	if oauthConfig == nil {
 		return nil, stacktrace.NewError("oauthConfig can't be nil")
@@ -54,17 +391,108 @@ func AuthenticateUser(oauthConfig *oauth2.Config, options ...AuthenticateUserOpt
 		processConfigFunc(&optionsConfig)
 	}
 
-	// add transport for self-signed certificate to context
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	timeout := optionsConfig.Timeout
+	if timeout == 0 {
+		timeout = defaultAuthTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	httpClient := optionsConfig.HTTPClient
+	if httpClient == nil {
+		if optionsConfig.InsecureSkipVerify {
+			httpClient = &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+		} else {
+			httpClient = http.DefaultClient
+		}
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+
+	// clientCtx is long-lived (not scoped to this attempt's timeout): the
+	// returned AuthorizedClient's token source holds whichever ctx it was
+	// built with and reuses it for future refreshes, so building it from
+	// ctx above (cancelled by the deferred cancel() once AuthenticateUser
+	// returns) would make the caller's first refresh fail with "context
+	// canceled". ctx itself still bounds the exchange/wait below.
+	clientCtx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+
+	var cacheKey SessionCacheKey
+	if optionsConfig.SessionCache != nil {
+		cacheKey = SessionCacheKey{Issuer: oauthConfig.Endpoint.TokenURL, ClientID: oauthConfig.ClientID, Scopes: oauthConfig.Scopes}
+		minValidity := optionsConfig.MinTokenValidity
+		if minValidity == 0 {
+			minValidity = defaultMinTokenValidity
+		}
+		if client := cachedClient(ctx, clientCtx, oauthConfig, optionsConfig.SessionCache.Get(cacheKey), minValidity); client != nil {
+			// client.Token may be a freshly refreshed token (different from what
+			// Get returned); persist it so the next run doesn't refresh again
+			// from the now-stale one, which would fail for rotating refresh tokens.
+			optionsConfig.SessionCache.Put(cacheKey, client.Token)
+			return client, nil
+		}
+	}
+
+	callbackPath := optionsConfig.CallbackPath
+	if callbackPath == "" {
+		callbackPath = defaultCallbackPath
+	}
+
+	// Work against a shallow copy from here on: RedirectURL is request-specific
+	// (it encodes the loopback port we just picked), so writing it through the
+	// caller's shared *oauth2.Config would race and cross-wire concurrent
+	// AuthenticateUser calls sharing the same config.
+	cfg := *oauthConfig
+	oauthConfig = &cfg
+
+	var listener net.Listener
+	if optionsConfig.ManualAuth {
+		// headless flow: no listener, provider shows the code instead of
+		// redirecting to one
+		oauthConfig.RedirectURL = optionsConfig.RedirectURL
+		if oauthConfig.RedirectURL == "" {
+			oauthConfig.RedirectURL = oobRedirectURI
+		}
+	} else {
+		// set up the callback listener before building the authorization URL, so
+		// we know the actual port (and can advertise the real redirect URL)
+		listener = optionsConfig.Listener
+		if listener == nil {
+			listenAddress := optionsConfig.ListenAddress
+			if listenAddress == "" {
+				listenAddress = defaultListenAddress
+			}
+			var err error
+			listener, err = net.Listen("tcp", listenAddress)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "failed starting listener on %s", listenAddress)
+			}
+		}
+		oauthConfig.RedirectURL = optionsConfig.RedirectURL
+		if oauthConfig.RedirectURL == "" {
+			oauthConfig.RedirectURL = fmt.Sprintf("http://%s%s", listener.Addr().String(), callbackPath)
+		}
 	}
-	sslcli := &http.Client{Transport: tr}
-	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, sslcli)
 
 	// Some random string, random for each request
 	oauthStateString := rndm.String(8)
 	ctx = context.WithValue(ctx, oauthStateStringContextKey, oauthStateString)
-	urlString := oauthConfig.AuthCodeURL(oauthStateString, oauth2.AccessTypeOffline)
+
+	var exchangeOpts []oauth2.AuthCodeOption
+	authCodeOpts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+	if optionsConfig.PKCE {
+		verifier, err := generatePKCECodeVerifier()
+		if err != nil {
+			return nil, err
+		}
+		authCodeOpts = append(authCodeOpts,
+			oauth2.SetAuthURLParam("code_challenge", pkceCodeChallenge(verifier, optionsConfig.PKCEMethod)),
+			oauth2.SetAuthURLParam("code_challenge_method", optionsConfig.PKCEMethod),
+		)
+		exchangeOpts = append(exchangeOpts, oauth2.SetAuthURLParam("code_verifier", verifier))
+	}
+	urlString := oauthConfig.AuthCodeURL(oauthStateString, authCodeOpts...)
 
 	if optionsConfig.AuthCallHTTPParams != nil {
 		parsedURL, err := url.Parse(urlString)
@@ -79,7 +507,37 @@ func AuthenticateUser(oauthConfig *oauth2.Config, options ...AuthenticateUserOpt
 		urlString = parsedURL.String()
 	}
 
-	clientChan, stopHTTPServerChan, cancelAuthentication := startHTTPServer(ctx, oauthConfig)
+	if optionsConfig.ManualAuth {
+		client, err := manualAuthenticate(ctx, clientCtx, oauthConfig, urlString, optionsConfig.ManualAuthInput, exchangeOpts...)
+		if err != nil {
+			return nil, err
+		}
+		if optionsConfig.SessionCache != nil {
+			optionsConfig.SessionCache.Put(cacheKey, client.Token)
+		}
+		return client, nil
+	}
+
+	successTemplate := optionsConfig.SuccessTemplate
+	if successTemplate == nil {
+		successTemplate = defaultSuccessTemplate
+	}
+	errorTemplate := optionsConfig.ErrorTemplate
+	if errorTemplate == nil {
+		errorTemplate = defaultErrorTemplate
+	}
+	autoCloseSeconds := optionsConfig.AutoCloseSeconds
+	if autoCloseSeconds == 0 {
+		autoCloseSeconds = defaultAutoCloseSeconds
+	}
+	pages := responsePages{
+		success:          successTemplate,
+		error:            errorTemplate,
+		providerName:     optionsConfig.ProviderName,
+		autoCloseSeconds: autoCloseSeconds,
+	}
+
+	clientChan := startHTTPServer(ctx, clientCtx, oauthConfig, listener, callbackPath, pages, exchangeOpts...)
 	log.Println(color.CyanString("You will now be taken to your browser for authentication"))
 	time.Sleep(1000 * time.Millisecond)
 	err := open.Run(urlString)
@@ -89,91 +547,154 @@ func AuthenticateUser(oauthConfig *oauth2.Config, options ...AuthenticateUserOpt
 	}
 	time.Sleep(600 * time.Millisecond)
 
-	spew.Dump(fmt.Sprintf("authentication will be cancelled in %s seconds", serverWaitTimeout))
-	serverTimeout := time.After(serverWaitTimeout)
+	log.Printf("authentication will be cancelled in %s", timeout)
 	select {
 	// wait for client on clientChan
 	case client := <-clientChan:
-		// After the callbackHandler returns a client, it's time to shutdown the server gracefully
-		stopHTTPServerChan <- struct{}{}
+		if optionsConfig.SessionCache != nil {
+			optionsConfig.SessionCache.Put(cacheKey, client.Token)
+		}
 		return client, nil
-		// if authentication process is cancelled first return an error
-	case <-cancelAuthentication:
-		return nil, fmt.Errorf("authentication timed out and was cancelled")
-	case <-serverTimeout:
-		stopHTTPServerChan <- struct{}{}
-		return nil, fmt.Errorf("server timeout was hit")
+		// ctx cancellation (caller cancel or timeout) shuts the server down; see startHTTPServer
+	case <-ctx.Done():
+		return nil, stacktrace.Propagate(ctx.Err(), "authentication was cancelled")
 	}
 }
 
-func startHTTPServer(ctx context.Context, conf *oauth2.Config) (clientChan chan *AuthorizedClient, stopHTTPServerChan chan struct{}, cancelAuthentication chan struct{}) {
-	// init returns
-	clientChan = make(chan *AuthorizedClient)
-	stopHTTPServerChan = make(chan struct{})
-	cancelAuthentication = make(chan struct{})
+// manualAuthenticate implements the WithManualAuth flow: print the
+// authorization URL, read back the authorization code typed/pasted by the
+// user, and exchange it directly, without starting a local HTTP server.
+// ctx bounds the exchange call; clientCtx is long-lived and is what the
+// returned AuthorizedClient's token source uses for future refreshes (see
+// the clientCtx comment in AuthenticateUser).
+func manualAuthenticate(ctx, clientCtx context.Context, oauthConfig *oauth2.Config, urlString string, input io.Reader, exchangeOpts ...oauth2.AuthCodeOption) (*AuthorizedClient, error) {
+	if input == nil {
+		input = os.Stdin
+	}
+
+	fmt.Println(color.CyanString("Go to the following link in your browser, then type the authorization code:"))
+	fmt.Println(urlString)
+	fmt.Print("Authorization code: ")
 
-	http.HandleFunc("/oauth/callback", callbackHandler(ctx, conf, clientChan))
-	srv := &http.Server{Addr: ":" + strconv.Itoa(PORT)}
+	scanner := bufio.NewScanner(input)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, stacktrace.Propagate(err, "failed reading authorization code")
+		}
+		return nil, stacktrace.NewError("no authorization code was entered")
+	}
+	code := strings.TrimSpace(scanner.Text())
+
+	token, err := oauthConfig.Exchange(ctx, code, exchangeOpts...)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "oauthConfig.Exchange() failed")
+	}
+	return &AuthorizedClient{
+		oauthConfig.Client(clientCtx, token),
+		token,
+	}, nil
+}
+
+// responsePages bundles the templates and data used to render the
+// browser-facing callback response.
+type responsePages struct {
+	success          *template.Template
+	error            *template.Template
+	providerName     string
+	autoCloseSeconds int
+}
+
+// startHTTPServer runs the temporary callback server on its own ServeMux
+// (never http.DefaultServeMux, so concurrent/sequential auth attempts and
+// the host program's own routes don't collide) and shuts it down as soon as
+// ctx is done, however that happens: success, caller cancellation, or
+// timeout. clientCtx is long-lived and is passed through to callbackHandler
+// for building the returned AuthorizedClient (see the clientCtx comment in
+// AuthenticateUser).
+func startHTTPServer(ctx, clientCtx context.Context, conf *oauth2.Config, listener net.Listener, callbackPath string, pages responsePages, exchangeOpts ...oauth2.AuthCodeOption) (clientChan chan *AuthorizedClient) {
+	// buffered so the callback handler's send doesn't block forever if
+	// AuthenticateUser has already returned via ctx.Done() by the time the
+	// handler finishes
+	clientChan = make(chan *AuthorizedClient, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, callbackHandler(ctx, clientCtx, conf, clientChan, pages, exchangeOpts...))
+	srv := &http.Server{Handler: mux}
 
-	// handle server shutdown signal
 	go func() {
-		// wait for signal on stopHTTPServerChan
-		<-stopHTTPServerChan
+		<-ctx.Done()
 		log.Println("Shutting down server...")
 
-		// give it 5 sec to shutdown gracefully, else quit program
-		d := time.Now().Add(5 * time.Second)
-		ctx, cancel := context.WithDeadline(context.Background(), d)
+		// give it 5 sec to shutdown gracefully, else drop the connection
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		if err := srv.Shutdown(ctx); err != nil {
-			log.Fatalf("could not shutdown gracefully: %v", err)
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("oauth2ns: server did not shut down gracefully: %v", err)
 		}
-
-		// after server is shutdown, quit program
-		cancelAuthentication <- struct{}{}
 	}()
 
 	// handle callback request
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("oauth2ns: callback server stopped unexpectedly: %v", err)
 		}
 		fmt.Println("Server gracefully stopped")
 	}()
 
-	return clientChan, stopHTTPServerChan, cancelAuthentication
+	return clientChan
 }
 
-func callbackHandler(ctx context.Context, oauthConfig *oauth2.Config, clientChan chan *AuthorizedClient) func(w http.ResponseWriter, r *http.Request) {
+// ctx bounds the token exchange; clientCtx is long-lived and is what the
+// returned AuthorizedClient's token source uses for future refreshes (see
+// the clientCtx comment in AuthenticateUser).
+func callbackHandler(ctx, clientCtx context.Context, oauthConfig *oauth2.Config, clientChan chan *AuthorizedClient, pages responsePages, exchangeOpts ...oauth2.AuthCodeOption) func(w http.ResponseWriter, r *http.Request) {
+	renderError := func(w http.ResponseWriter, title, message string) {
+		setSecurityHeaders(w, "")
+		w.WriteHeader(http.StatusBadRequest)
+		pages.error.Execute(w, ResponsePageData{
+			Title:        title,
+			Message:      message,
+			ProviderName: pages.providerName,
+		})
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestStateString := ctx.Value(oauthStateStringContextKey).(string)
 		responseStateString := r.FormValue("state")
 		if responseStateString != requestStateString {
 			fmt.Printf("invalid oauth state, expected '%s', got '%s'\n", requestStateString, responseStateString)
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			renderError(w, "Authentication failed", "Invalid OAuth state. Please restart the authentication process.")
 			return
 		}
 
 		code := r.FormValue("code")
-		token, err := oauthConfig.Exchange(ctx, code)
+		token, err := oauthConfig.Exchange(ctx, code, exchangeOpts...)
 		if err != nil {
 			fmt.Printf("oauthoauthConfig.Exchange() failed with '%s'\n", err)
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			renderError(w, "Authentication failed", "The authorization code could not be exchanged for a token. Please restart the authentication process.")
 			return
 		}
 		// The HTTP Client returned by oauthConfig.Client will refresh the token as necessary
 		client := &AuthorizedClient{
-			oauthConfig.Client(ctx, token),
+			oauthConfig.Client(clientCtx, token),
 			token,
 		}
-		// show success page
-		successPage := `
-		<div style="height:100px; width:100%!; display:flex; flex-direction: column; justify-content: center; align-items:center; background-color:#2ecc71; color:white; font-size:22"><div>Success!</div></div>
-		<p style="margin-top:20px; font-size:18; text-align:center">You are authenticated, you can now return to the program. This will auto-close</p>
-		<script>window.onload=function(){setTimeout(this.close, 4000)}</script>
-		`
-		fmt.Fprintf(w, successPage)
+
+		nonce, err := cspNonce()
+		if err != nil {
+			fmt.Printf("failed generating CSP nonce: %s\n", err)
+			renderError(w, "Authentication failed", "An internal error occurred. Please restart the authentication process.")
+			return
+		}
+		setSecurityHeaders(w, nonce)
+		pages.success.Execute(w, ResponsePageData{
+			Title:            "Success!",
+			Message:          "You are authenticated, you can now return to the program. This will auto-close",
+			AutoCloseSeconds: pages.autoCloseSeconds,
+			ProviderName:     pages.providerName,
+			ScriptNonce:      nonce,
+		})
 		// quitSignalChan <- quitSignal
 		clientChan <- client
 	}
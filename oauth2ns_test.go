@@ -0,0 +1,35 @@
+package oauth2ns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePKCECodeVerifier(t *testing.T) {
+	verifier, err := generatePKCECodeVerifier()
+	if err != nil {
+		t.Fatalf("generatePKCECodeVerifier() error = %v", err)
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Fatalf("verifier length = %d, want between 43 and 128 (RFC 7636 4.1)", len(verifier))
+	}
+	const unreserved = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~"
+	for _, r := range verifier {
+		if !strings.ContainsRune(unreserved, r) {
+			t.Fatalf("verifier contains disallowed character %q", r)
+		}
+	}
+}
+
+func TestPKCECodeChallenge(t *testing.T) {
+	// known-answer test vector from RFC 7636 appendix B
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const wantS256 = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if got := pkceCodeChallenge(verifier, pkceMethodPlain); got != verifier {
+		t.Errorf("plain challenge = %q, want %q", got, verifier)
+	}
+	if got := pkceCodeChallenge(verifier, pkceMethodS256); got != wantS256 {
+		t.Errorf("S256 challenge = %q, want %q", got, wantS256)
+	}
+}
@@ -0,0 +1,115 @@
+package oauth2ns
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/oauth2"
+)
+
+// SessionCache stores and retrieves OAuth2 tokens across process runs, keyed
+// by issuer, client ID and requested scopes, so repeated AuthenticateUser
+// calls can skip the interactive browser/server flow when a valid or
+// refreshable token is already on hand. Modeled on Pinniped's SessionCache.
+type SessionCache interface {
+	Get(key SessionCacheKey) *oauth2.Token
+	Put(key SessionCacheKey, token *oauth2.Token)
+}
+
+// SessionCacheKey identifies a cached token.
+type SessionCacheKey struct {
+	Issuer   string
+	ClientID string
+	Scopes   []string
+}
+
+func (k SessionCacheKey) cacheKey() string {
+	scopes := append([]string(nil), k.Scopes...)
+	sort.Strings(scopes)
+	return strings.Join([]string{k.Issuer, k.ClientID, strings.Join(scopes, ",")}, "|")
+}
+
+// FileCache is the default SessionCache: tokens are stored as JSON in a
+// single file under Dir. See DefaultCacheDir for where that is by default.
+type FileCache struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+// NewFileCache returns a FileCache rooted at dir, creating dir if it doesn't
+// already exist.
+func NewFileCache(dir string) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, stacktrace.Propagate(err, "failed creating cache dir %s", dir)
+	}
+	return &FileCache{Dir: dir}, nil
+}
+
+// DefaultCacheDir returns $XDG_CACHE_HOME/oauth2ns, falling back to
+// $HOME/.cache/oauth2ns when XDG_CACHE_HOME is unset.
+func DefaultCacheDir() (string, error) {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "oauth2ns"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed resolving home directory")
+	}
+	return filepath.Join(home, ".cache", "oauth2ns"), nil
+}
+
+func (c *FileCache) path() string {
+	return filepath.Join(c.Dir, "tokens.json")
+}
+
+func (c *FileCache) load() (map[string]*oauth2.Token, error) {
+	tokens := map[string]*oauth2.Token{}
+	data, err := os.ReadFile(c.path())
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading cache file %s", c.path())
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, stacktrace.Propagate(err, "failed parsing cache file %s", c.path())
+	}
+	return tokens, nil
+}
+
+// Get returns the cached token for key, or nil if there is none or the
+// cache file can't be read.
+func (c *FileCache) Get(key SessionCacheKey) *oauth2.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tokens, err := c.load()
+	if err != nil {
+		return nil
+	}
+	return tokens[key.cacheKey()]
+}
+
+// Put stores token under key, overwriting any previous entry.
+func (c *FileCache) Put(key SessionCacheKey, token *oauth2.Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tokens, err := c.load()
+	if err != nil {
+		tokens = map[string]*oauth2.Token{}
+	}
+	tokens[key.cacheKey()] = token
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(c.path(), data, 0600)
+}
@@ -0,0 +1,55 @@
+package oauth2ns
+
+import (
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSessionCacheKeyCacheKeyScopeOrderNormalization(t *testing.T) {
+	a := SessionCacheKey{Issuer: "https://issuer.example", ClientID: "client", Scopes: []string{"b", "a"}}
+	b := SessionCacheKey{Issuer: "https://issuer.example", ClientID: "client", Scopes: []string{"a", "b"}}
+
+	if a.cacheKey() != b.cacheKey() {
+		t.Errorf("cacheKey() not order-independent: %q != %q", a.cacheKey(), b.cacheKey())
+	}
+}
+
+func TestSessionCacheKeyCacheKeyDistinguishesClients(t *testing.T) {
+	a := SessionCacheKey{Issuer: "https://issuer.example", ClientID: "client-a", Scopes: []string{"openid"}}
+	b := SessionCacheKey{Issuer: "https://issuer.example", ClientID: "client-b", Scopes: []string{"openid"}}
+
+	if a.cacheKey() == b.cacheKey() {
+		t.Errorf("cacheKey() collided for different ClientIDs: %q", a.cacheKey())
+	}
+}
+
+func TestFileCacheRoundTrip(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileCache() error = %v", err)
+	}
+
+	key := SessionCacheKey{Issuer: "https://issuer.example", ClientID: "client", Scopes: []string{"openid", "email"}}
+	if got := cache.Get(key); got != nil {
+		t.Fatalf("Get() on empty cache = %v, want nil", got)
+	}
+
+	token := &oauth2.Token{AccessToken: "test-token", TokenType: "bearer"}
+	cache.Put(key, token)
+
+	got := cache.Get(key)
+	if got == nil || got.AccessToken != token.AccessToken {
+		t.Fatalf("Get() after Put() = %v, want AccessToken %q", got, token.AccessToken)
+	}
+
+	// a fresh FileCache pointed at the same dir should see the persisted token
+	reopened, err := NewFileCache(cache.Dir)
+	if err != nil {
+		t.Fatalf("NewFileCache() error = %v", err)
+	}
+	got = reopened.Get(key)
+	if got == nil || got.AccessToken != token.AccessToken {
+		t.Fatalf("Get() from reopened cache = %v, want AccessToken %q", got, token.AccessToken)
+	}
+}